@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	stdhtml "html"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// textStripper removes every tag, leaving just the text content, for the
+// HTML-to-text fallback below.
+var textStripper = bluemonday.StrictPolicy()
+
+// urlPattern finds bare URLs in already-HTML-escaped plain text so they can
+// be linkified.
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// htmlToText synthesizes a plain-text body from an HTML part, for senders
+// that only provide text/html. Without this, HTML-only mail has an empty
+// body column and is invisible to the body FTS column.
+func htmlToText(htmlBody string) string {
+	text := stdhtml.UnescapeString(textStripper.Sanitize(htmlBody))
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// textToHTML synthesizes an HTML rendering of a plain-text body, for
+// senders that only provide text/plain. It escapes the text, linkifies
+// bare URLs, and preserves line wrapping, so the UI has something better
+// than a raw <pre> block to show.
+func textToHTML(text string) string {
+	escaped := stdhtml.EscapeString(text)
+	linkified := urlPattern.ReplaceAllStringFunc(escaped, func(u string) string {
+		return fmt.Sprintf(`<a href="%s" rel="noopener noreferrer" target="_blank">%s</a>`, u, u)
+	})
+	linkified = strings.ReplaceAll(linkified, "\r\n", "\n")
+	linkified = strings.ReplaceAll(linkified, "\n", "<br>")
+	return `<div style="white-space:pre-wrap;font-family:inherit">` + linkified + `</div>`
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-message"
+	mtextproto "github.com/emersion/go-message/textproto"
+)
+
+// The IMAP frontend exposes the emails table as a single read-mostly
+// INBOX: UIDs are email row IDs, sequence numbers follow timestamp
+// (insertion) order, and UIDVALIDITY is fixed since rows are never
+// renumbered. Authentication is not checked - any username and password
+// (including none) is accepted, and there is no option to require it -
+// since MailSink is meant to be pointed at from trusted dev/CI environments.
+
+// imapBackend is the emersion/go-imap backend.Backend implementation
+// backed by the SQLite store.
+type imapBackend struct{}
+
+func (b *imapBackend) Login(_ *imap.ConnInfo, username, password string) (backend.User, error) {
+	return &imapUser{username: username}, nil
+}
+
+type imapUser struct {
+	username string
+}
+
+func (u *imapUser) Username() string { return u.username }
+
+func (u *imapUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	return []backend.Mailbox{&imapMailbox{}}, nil
+}
+
+func (u *imapUser) GetMailbox(name string) (backend.Mailbox, error) {
+	if !strings.EqualFold(name, "INBOX") {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return &imapMailbox{}, nil
+}
+
+func (u *imapUser) CreateMailbox(name string) error {
+	return errors.New("mailsink: creating mailboxes is not supported")
+}
+
+func (u *imapUser) DeleteMailbox(name string) error {
+	return errors.New("mailsink: deleting mailboxes is not supported")
+}
+
+func (u *imapUser) RenameMailbox(existingName, newName string) error {
+	return errors.New("mailsink: renaming mailboxes is not supported")
+}
+
+func (u *imapUser) Logout() error { return nil }
+
+// imapMailbox is the single virtual INBOX backed by the emails table.
+type imapMailbox struct{}
+
+func (mb *imapMailbox) Name() string { return "INBOX" }
+
+func (mb *imapMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: "/", Name: "INBOX"}, nil
+}
+
+func (mb *imapMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus("INBOX", items)
+	status.Flags = []string{imap.SeenFlag, imap.DeletedFlag}
+	status.PermanentFlags = []string{imap.SeenFlag, imap.DeletedFlag, "\\*"}
+
+	ids, err := mb.orderedIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	status.UnseenSeqNum = 0
+	for i, id := range ids {
+		seen, _, err := mb.flagsFor(id)
+		if err != nil {
+			return nil, err
+		}
+		if !seen {
+			status.UnseenSeqNum = uint32(i + 1)
+			break
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(ids))
+		case imap.StatusUidNext:
+			var next int64
+			if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) + 1 FROM emails`).Scan(&next); err != nil {
+				return nil, err
+			}
+			status.UidNext = uint32(next)
+		case imap.StatusUidValidity:
+			status.UidValidity = 1
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			var unseen uint32
+			for _, id := range ids {
+				seen, _, err := mb.flagsFor(id)
+				if err != nil {
+					return nil, err
+				}
+				if !seen {
+					unseen++
+				}
+			}
+			status.Unseen = unseen
+		}
+	}
+
+	return status, nil
+}
+
+func (mb *imapMailbox) SetSubscribed(subscribed bool) error { return nil }
+
+func (mb *imapMailbox) Check() error { return nil }
+
+// orderedIDs returns every email's row ID ordered the way sequence numbers
+// are assigned: oldest first.
+func (mb *imapMailbox) orderedIDs() ([]int64, error) {
+	rows, err := db.Query(`SELECT id FROM emails ORDER BY id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (mb *imapMailbox) flagsFor(id int64) (seen, deleted bool, err error) {
+	var raw string
+	if err := db.QueryRow(`SELECT flags FROM emails WHERE id = ?`, id).Scan(&raw); err != nil {
+		return false, false, err
+	}
+	for _, f := range strings.Fields(raw) {
+		switch f {
+		case imap.SeenFlag:
+			seen = true
+		case imap.DeletedFlag:
+			deleted = true
+		}
+	}
+	return seen, deleted, nil
+}
+
+func (mb *imapMailbox) loadMessage(id int64, seqNum uint32) (*imapMessage, error) {
+	var raw, flagsRaw string
+	var ts time.Time
+	err := db.QueryRow(`SELECT raw, flags, timestamp FROM emails WHERE id = ?`, id).Scan(&raw, &flagsRaw, &ts)
+	if err != nil {
+		return nil, err
+	}
+	return &imapMessage{
+		id:     id,
+		seqNum: seqNum,
+		date:   ts,
+		raw:    []byte(raw),
+		flags:  strings.Fields(flagsRaw),
+	}, nil
+}
+
+func (mb *imapMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	ids, err := mb.orderedIDs()
+	if err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		seqNum := uint32(i + 1)
+		target := seqNum
+		if uid {
+			target = uint32(id)
+		}
+		if !seqset.Contains(target) {
+			continue
+		}
+
+		msg, err := mb.loadMessage(id, seqNum)
+		if err != nil {
+			continue
+		}
+
+		fetched, err := msg.Fetch(items)
+		if err != nil {
+			continue
+		}
+		ch <- fetched
+	}
+
+	return nil
+}
+
+// ftsQueryFor translates the subset of an IMAP SEARCH criteria that maps
+// cleanly onto the emails_fts index (SUBJECT/FROM/TO/BODY, with no
+// OR/NOT/flags/date terms) into an FTS5 MATCH query. The second return
+// value reports whether the translation was possible.
+func ftsQueryFor(c *imap.SearchCriteria) (string, bool) {
+	if len(c.Not) > 0 || len(c.Or) > 0 || c.SeqNum != nil || c.Uid != nil ||
+		len(c.WithFlags) > 0 || len(c.WithoutFlags) > 0 ||
+		!c.Since.IsZero() || !c.Before.IsZero() || !c.SentSince.IsZero() || !c.SentBefore.IsZero() ||
+		c.Larger > 0 || c.Smaller > 0 || len(c.Text) > 0 {
+		return "", false
+	}
+
+	var terms []string
+	for key, values := range c.Header {
+		column, ok := map[string]string{"Subject": "subject", "From": "from_addr", "To": "to_addr"}[key]
+		if !ok {
+			return "", false
+		}
+		for _, v := range values {
+			if v == "" {
+				continue
+			}
+			terms = append(terms, column+":"+quoteFTS(v))
+		}
+	}
+	for _, v := range c.Body {
+		if v == "" {
+			continue
+		}
+		terms = append(terms, "body:"+quoteFTS(v))
+	}
+
+	if len(terms) == 0 {
+		return "", false
+	}
+	return strings.Join(terms, " AND "), true
+}
+
+func quoteFTS(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func (mb *imapMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	ids, err := mb.orderedIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	if query, ok := ftsQueryFor(criteria); ok {
+		rows, err := db.Query(`
+			SELECT e.id
+			FROM emails e
+			JOIN emails_fts ON e.id = emails_fts.rowid
+			WHERE emails_fts MATCH ?
+		`, query)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		matched := make(map[int64]bool)
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				return nil, err
+			}
+			matched[id] = true
+		}
+
+		var results []uint32
+		for i, id := range ids {
+			if !matched[id] {
+				continue
+			}
+			if uid {
+				results = append(results, uint32(id))
+			} else {
+				results = append(results, uint32(i+1))
+			}
+		}
+		return results, nil
+	}
+
+	var results []uint32
+	for i, id := range ids {
+		seqNum := uint32(i + 1)
+		msg, err := mb.loadMessage(id, seqNum)
+		if err != nil {
+			continue
+		}
+		ok, err := msg.Match(criteria)
+		if err != nil || !ok {
+			continue
+		}
+		if uid {
+			results = append(results, uint32(id))
+		} else {
+			results = append(results, seqNum)
+		}
+	}
+	return results, nil
+}
+
+func (mb *imapMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return errors.New("mailsink: APPEND is not supported; send mail over SMTP instead")
+}
+
+func (mb *imapMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	ids, err := mb.orderedIDs()
+	if err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		seqNum := uint32(i + 1)
+		target := seqNum
+		if uid {
+			target = uint32(id)
+		}
+		if !seqset.Contains(target) {
+			continue
+		}
+
+		var current string
+		if err := db.QueryRow(`SELECT flags FROM emails WHERE id = ?`, id).Scan(&current); err != nil {
+			return err
+		}
+		updated := backendutil.UpdateFlags(strings.Fields(current), op, flags)
+		if _, err := db.Exec(`UPDATE emails SET flags = ? WHERE id = ?`, strings.Join(updated, " "), id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (mb *imapMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	if strings.EqualFold(destName, "INBOX") {
+		return nil
+	}
+	return backend.ErrNoSuchMailbox
+}
+
+func (mb *imapMailbox) Expunge() error {
+	rows, err := db.Query(`SELECT id FROM emails WHERE flags LIKE '%' || ? || '%'`, imap.DeletedFlag)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if _, err := db.Exec(`DELETE FROM emails WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imapMessage adapts a stored raw email into the shape backendutil expects,
+// mirroring the pattern used by go-imap's own in-memory backend.
+type imapMessage struct {
+	id     int64
+	seqNum uint32
+	date   time.Time
+	raw    []byte
+	flags  []string
+}
+
+func (m *imapMessage) entity() (*message.Entity, error) {
+	return message.Read(bytes.NewReader(m.raw))
+}
+
+func (m *imapMessage) headerAndBody() (mtextproto.Header, io.Reader, error) {
+	body := bufio.NewReader(bytes.NewReader(m.raw))
+	hdr, err := mtextproto.ReadHeader(body)
+	return hdr, body, err
+}
+
+func (m *imapMessage) Fetch(items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(m.seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, _, _ := m.headerAndBody()
+			fetched.Envelope, _ = backendutil.FetchEnvelope(hdr)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			hdr, body, _ := m.headerAndBody()
+			fetched.BodyStructure, _ = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			fetched.Flags = m.flags
+		case imap.FetchInternalDate:
+			fetched.InternalDate = m.date
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(len(m.raw))
+		case imap.FetchUid:
+			fetched.Uid = uint32(m.id)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				continue
+			}
+			hdr, body, err := m.headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			l, _ := backendutil.FetchBodySection(hdr, body, section)
+			fetched.Body[section] = l
+		}
+	}
+	return fetched, nil
+}
+
+func (m *imapMessage) Match(c *imap.SearchCriteria) (bool, error) {
+	e, err := m.entity()
+	if err != nil {
+		return false, err
+	}
+	return backendutil.Match(e, m.seqNum, uint32(m.id), m.date, m.flags, c)
+}
+
+// startIMAPServer runs a read-mostly IMAP4rev1 server over addr, optionally
+// with TLS if certFile/keyFile are given. It blocks until the listener
+// fails, so it must be run in its own goroutine.
+func startIMAPServer(addr, certFile, keyFile string) error {
+	s := server.New(&imapBackend{})
+	s.Addr = addr
+	s.AllowInsecureAuth = true
+
+	if certFile != "" && keyFile != "" {
+		cert, err := tlsCertificate(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		s.TLSConfig = cert
+		log.Printf("Starting IMAP server on %s with TLS", addr)
+		return s.ListenAndServeTLS()
+	}
+
+	log.Printf("Starting IMAP server on %s", addr)
+	return s.ListenAndServe()
+}
@@ -2,44 +2,68 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"database/sql"
 	"embed"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"html/template"
 	"io"
 	"log"
 	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
 	"net/http"
 	"net/mail"
 	"net/smtp"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/buildkite/terminal-to-html/v3"
 	"github.com/chrj/smtpd"
-	"github.com/microcosm-cc/bluemonday"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/microcosm-cc/bluemonday"
 )
 
 //go:embed templates/*
 var templatesFS embed.FS
 
 type Email struct {
-	ID            int64     `json:"id"`
-	From          string    `json:"from"`
-	To            string    `json:"to"`
-	Subject       string    `json:"subject"`
-	Body          string    `json:"body"`
-	HTML          string    `json:"html"`
-	SanitizedHTML string    `json:"sanitizedHtml"`
-	AnsiHTML      string    `json:"ansiHtml"`
-	Raw           string    `json:"raw"`
-	Timestamp     time.Time `json:"timestamp"`
-	ContentType   string    `json:"contentType"`
-	HasAnsi       bool      `json:"hasAnsi"`
+	ID            int64        `json:"id"`
+	From          string       `json:"from"`
+	To            string       `json:"to"`
+	Subject       string       `json:"subject"`
+	Body          string       `json:"body"`
+	HTML          string       `json:"html"`
+	SanitizedHTML string       `json:"sanitizedHtml"`
+	AnsiHTML      string       `json:"ansiHtml"`
+	Raw           string       `json:"raw"`
+	Timestamp     time.Time    `json:"timestamp"`
+	ContentType   string       `json:"contentType"`
+	HasAnsi       bool         `json:"hasAnsi"`
+	Attachments   []Attachment `json:"attachments,omitempty"`
+	SPFResult     string       `json:"spfResult"`
+	DKIMResult    string       `json:"dkimResult"`
+	DMARCResult   string       `json:"dmarcResult"`
+}
+
+// Attachment is a non-inline MIME part persisted alongside its parent email.
+type Attachment struct {
+	ID          int64  `json:"id"`
+	EmailID     int64  `json:"emailId"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	ContentID   string `json:"contentId"`
+	SHA256      string `json:"sha256"`
+	Data        []byte `json:"-"`
 }
 
 var (
@@ -52,7 +76,13 @@ var (
 func initSanitizer() {
 	htmlSanitizer = bluemonday.UGCPolicy()
 	htmlSanitizer.AllowAttrs("style").OnElements("p", "div", "span", "h1", "h2", "h3", "h4", "h5", "h6")
-	htmlSanitizer.AllowStyles("color", "background-color", "font-weight", "font-style", "text-decoration", "text-align").Globally()
+	htmlSanitizer.AllowStyles("color", "background-color", "font-weight", "font-style", "text-decoration", "text-align", "white-space", "font-family").Globally()
+	// textToHTML (bodyconv.go) marks its synthesized links target="_blank"
+	// rel="noopener noreferrer"; UGCPolicy only allows href on <a> by
+	// default, so these need to be allowed explicitly or they're silently
+	// stripped.
+	htmlSanitizer.AllowAttrs("target").Matching(regexp.MustCompile(`^_blank$`)).OnElements("a")
+	htmlSanitizer.AllowAttrs("rel").Matching(bluemonday.SpaceSeparatedTokens).OnElements("a")
 }
 
 func hasAnsiCodes(text string) bool {
@@ -63,17 +93,17 @@ func hasAnsiCodes(text string) bool {
 func convertAnsiToHTML(text string) string {
 	// Convert ANSI codes to HTML
 	html := string(terminal.Render([]byte(text)))
-	
+
 	// The terminal library doesn't preserve line breaks, so we need to ensure they're converted to <br>
 	// Replace newlines with <br> tags while preserving the ANSI-converted HTML
 	html = strings.ReplaceAll(html, "\n", "<br>")
-	
+
 	return html
 }
 
 func initDB(dbPath string) error {
 	var err error
-	db, err = sql.Open("sqlite3", dbPath)
+	db, err = sql.Open("sqlite3", dbPath+"?_foreign_keys=on")
 	if err != nil {
 		return err
 	}
@@ -90,6 +120,19 @@ func initDB(dbPath string) error {
 		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
 
+	CREATE TABLE IF NOT EXISTS attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email_id INTEGER NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+		filename TEXT,
+		content_type TEXT,
+		size INTEGER,
+		content_id TEXT,
+		sha256 TEXT,
+		data BLOB
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_attachments_email_id ON attachments(email_id);
+
 	CREATE VIRTUAL TABLE IF NOT EXISTS emails_fts USING fts5(
 		subject, body, from_addr, to_addr,
 		content=emails,
@@ -112,10 +155,61 @@ func initDB(dbPath string) error {
 	END;
 	`
 
-	_, err = db.Exec(schema)
+	if _, err = db.Exec(schema); err != nil {
+		return err
+	}
+
+	if err := ensureColumn("emails", "flags", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureColumn("emails", "spf_result", "TEXT NOT NULL DEFAULT 'none'"); err != nil {
+		return err
+	}
+	if err := ensureColumn("emails", "dkim_result", "TEXT NOT NULL DEFAULT 'none'"); err != nil {
+		return err
+	}
+	return ensureColumn("emails", "dmarc_result", "TEXT NOT NULL DEFAULT 'none'")
+}
+
+// ensureColumn adds column to table if it isn't already there. SQLite has
+// no "ADD COLUMN IF NOT EXISTS", so schema additions made after the initial
+// release are migrated this way instead.
+func ensureColumn(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
 	return err
 }
 
+// tlsCertificate loads a certificate/key pair into a *tls.Config suitable
+// for the optional TLS listeners (IMAP, POP3).
+func tlsCertificate(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
 func forwardEmail(from string, recipients []string, data []byte) error {
 	// Connect to the SMTP server
 	c, err := smtp.Dial(forwardAddr)
@@ -165,22 +259,73 @@ func forwardEmail(from string, recipients []string, data []byte) error {
 func mailHandler(peer smtpd.Peer, env smtpd.Envelope) error {
 	from := env.Sender
 	recipients := strings.Join(env.Recipients, ", ")
-	
+
 	data := env.Data
 
 	rawEmail := string(data)
-	subject, body, html := parseEmail(rawEmail)
+	subject, body, html, attachments := parseEmail(rawEmail)
+
+	// Synthesize whichever of body/html the sender didn't provide, so the
+	// FTS index and the UI both work regardless of which part they sent.
+	if body == "" && html != "" {
+		body = htmlToText(html)
+	} else if html == "" && body != "" && !hasAnsiCodes(body) {
+		html = textToHTML(body)
+	}
+
+	auth := verifyEmail(peer, from, rawEmail)
 
-	_, err := db.Exec(`
-		INSERT INTO emails (from_addr, to_addr, subject, body, html, raw)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, from, recipients, subject, body, html, rawEmail)
+	res, err := db.Exec(`
+		INSERT INTO emails (from_addr, to_addr, subject, body, html, raw, spf_result, dkim_result, dmarc_result)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, from, recipients, subject, body, html, rawEmail, auth.SPF, auth.DKIM, auth.DMARC)
 
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Email received from %s to %s", from, recipients)
+	emailID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for i := range attachments {
+		attachments[i].EmailID = emailID
+		if _, err := db.Exec(`
+			INSERT INTO attachments (email_id, filename, content_type, size, content_id, sha256, data)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, emailID, attachments[i].Filename, attachments[i].ContentType, attachments[i].Size, attachments[i].ContentID, attachments[i].SHA256, attachments[i].Data); err != nil {
+			log.Printf("Failed to store attachment %q: %v", attachments[i].Filename, err)
+		}
+	}
+
+	log.Printf("Email received from %s to %s with %d attachment(s)", from, recipients, len(attachments))
+
+	e := Email{
+		ID:          emailID,
+		From:        from,
+		To:          recipients,
+		Subject:     subject,
+		Body:        body,
+		HTML:        html,
+		Raw:         rawEmail,
+		Timestamp:   time.Now(),
+		Attachments: attachments,
+		SPFResult:   string(auth.SPF),
+		DKIMResult:  string(auth.DKIM),
+		DMARCResult: string(auth.DMARC),
+	}
+	if e.HTML != "" {
+		e.ContentType = "text/html"
+		e.SanitizedHTML = htmlSanitizer.Sanitize(e.HTML)
+	} else {
+		e.ContentType = "text/plain"
+		if hasAnsiCodes(e.Body) {
+			e.HasAnsi = true
+			e.AnsiHTML = convertAnsiToHTML(e.Body)
+		}
+	}
+	publishEmail(e)
 
 	// Forward email if forwarding is enabled
 	if forwardAddr != "" {
@@ -194,10 +339,11 @@ func mailHandler(peer smtpd.Peer, env smtpd.Envelope) error {
 	return nil
 }
 
-func parseEmail(raw string) (subject, body, html string) {
+func parseEmail(raw string) (subject, body, html string, attachments []Attachment) {
 	msg, err := mail.ReadMessage(strings.NewReader(raw))
 	if err != nil {
-		return parseEmailSimple(raw)
+		subject, body, html = parseEmailSimple(raw)
+		return subject, body, html, nil
 	}
 
 	if msg.Header != nil {
@@ -211,49 +357,122 @@ func parseEmail(raw string) (subject, body, html string) {
 	}
 
 	if strings.HasPrefix(mediaType, "multipart/") {
-		mr := multipart.NewReader(msg.Body, params["boundary"])
-		for {
-			part, err := mr.NextPart()
-			if err == io.EOF {
-				break
+		body, html, attachments = walkParts(msg.Body, params["boundary"])
+	} else {
+		buf := new(bytes.Buffer)
+		_, _ = buf.ReadFrom(msg.Body)
+		content := string(decodeTransferEncoding(msg.Header.Get("Content-Transfer-Encoding"), buf.Bytes()))
+
+		if mediaType == "text/html" {
+			html = strings.TrimSpace(content)
+		} else {
+			body = strings.TrimSpace(content)
+		}
+	}
+
+	return subject, body, html, attachments
+}
+
+// walkParts recursively walks a multipart body (including nested
+// multipart/alternative and multipart/related parts), returning the first
+// text/plain part as body, the first text/html part as html, and every
+// part that isn't body text as an attachment. Later text/plain or
+// text/html body parts after the first of each are dropped.
+func walkParts(r io.Reader, boundary string) (body, html string, attachments []Attachment) {
+	mr := multipart.NewReader(r, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			break
+		}
+
+		partContentType := part.Header.Get("Content-Type")
+		partMediaType, partParams, _ := mime.ParseMediaType(partContentType)
+
+		if strings.HasPrefix(partMediaType, "multipart/") {
+			nestedBody, nestedHTML, nestedAttachments := walkParts(part, partParams["boundary"])
+			if body == "" {
+				body = nestedBody
 			}
-			if err != nil {
-				break
+			if html == "" {
+				html = nestedHTML
 			}
+			attachments = append(attachments, nestedAttachments...)
+			continue
+		}
 
-			partContentType := part.Header.Get("Content-Type")
-			partMediaType, _, _ := mime.ParseMediaType(partContentType)
+		buf := new(bytes.Buffer)
+		_, _ = buf.ReadFrom(part)
+		decoded := decodeTransferEncoding(part.Header.Get("Content-Transfer-Encoding"), buf.Bytes())
+
+		disposition, dispParams, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		filename := dispParams["filename"]
+		if filename == "" {
+			filename = partParams["name"]
+		}
 
-			buf := new(bytes.Buffer)
-			_, _ = buf.ReadFrom(part)
-			content := buf.String()
+		// A part is body text (rather than an attachment) only if it has no
+		// filename, isn't explicitly marked as an attachment, and is plain
+		// text or HTML. Anything else - images, PDFs, calendar invites, a
+		// second copy of text/plain in a multipart/alternative - either
+		// becomes an attachment or, for a redundant body/html part, is
+		// simply skipped.
+		isBodyCandidate := filename == "" && disposition != "attachment" &&
+			(partMediaType == "text/plain" || partMediaType == "text/html")
 
+		if isBodyCandidate {
 			if partMediaType == "text/plain" && body == "" {
-				body = strings.TrimSpace(content)
+				body = strings.TrimSpace(string(decoded))
 			} else if partMediaType == "text/html" && html == "" {
-				html = strings.TrimSpace(content)
+				html = strings.TrimSpace(string(decoded))
 			}
+			continue
 		}
-	} else {
-		buf := new(bytes.Buffer)
-		_, _ = buf.ReadFrom(msg.Body)
-		content := buf.String()
 
-		if mediaType == "text/html" {
-			html = strings.TrimSpace(content)
-		} else {
-			body = strings.TrimSpace(content)
-		}
+		sum := sha256.Sum256(decoded)
+		attachments = append(attachments, Attachment{
+			Filename:    filename,
+			ContentType: partMediaType,
+			Size:        int64(len(decoded)),
+			ContentID:   strings.Trim(part.Header.Get("Content-Id"), "<>"),
+			SHA256:      hex.EncodeToString(sum[:]),
+			Data:        decoded,
+		})
 	}
+	return body, html, attachments
+}
 
-	return subject, body, html
+// decodeTransferEncoding decodes a MIME part body according to its
+// Content-Transfer-Encoding header. Unknown or absent encodings are
+// returned unchanged (the common "7bit"/"8bit"/"binary" case).
+func decodeTransferEncoding(encoding string, data []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		n, err := base64.StdEncoding.Decode(decoded, bytes.ReplaceAll(data, []byte("\n"), nil))
+		if err != nil {
+			return data
+		}
+		return decoded[:n]
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return data
+		}
+		return decoded
+	default:
+		return data
+	}
 }
 
 func parseEmailSimple(raw string) (subject, body, html string) {
 	lines := strings.Split(raw, "\n")
 	inBody := false
 	isHTML := false
-	
+
 	for _, line := range lines {
 		if !inBody {
 			if strings.HasPrefix(line, "Subject: ") {
@@ -271,11 +490,13 @@ func parseEmailSimple(raw string) (subject, body, html string) {
 			}
 		}
 	}
-	
+
 	return strings.TrimSpace(subject), strings.TrimSpace(body), strings.TrimSpace(html)
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
+	// SPF/DKIM/DMARC results are on Email.SPFResult/DKIMResult/DMARCResult;
+	// render them as badges in templates/index.html's email list/detail views.
 	tmpl, err := template.ParseFS(templatesFS, "templates/index.html")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -308,7 +529,7 @@ func emailsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		rows, err = db.Query(`
-			SELECT e.id, e.from_addr, e.to_addr, e.subject, e.body, e.html, e.raw, e.timestamp
+			SELECT e.id, e.from_addr, e.to_addr, e.subject, e.body, e.html, e.raw, e.timestamp, e.spf_result, e.dkim_result, e.dmarc_result
 			FROM emails e
 			JOIN emails_fts ON e.id = emails_fts.rowid
 			WHERE emails_fts MATCH ?
@@ -317,7 +538,7 @@ func emailsHandler(w http.ResponseWriter, r *http.Request) {
 		`, ftsQuery)
 	} else {
 		rows, err = db.Query(`
-			SELECT id, from_addr, to_addr, subject, body, html, raw, timestamp
+			SELECT id, from_addr, to_addr, subject, body, html, raw, timestamp, spf_result, dkim_result, dmarc_result
 			FROM emails
 			ORDER BY timestamp DESC
 			LIMIT 100
@@ -333,11 +554,11 @@ func emailsHandler(w http.ResponseWriter, r *http.Request) {
 	var emails []Email
 	for rows.Next() {
 		var e Email
-		err := rows.Scan(&e.ID, &e.From, &e.To, &e.Subject, &e.Body, &e.HTML, &e.Raw, &e.Timestamp)
+		err := rows.Scan(&e.ID, &e.From, &e.To, &e.Subject, &e.Body, &e.HTML, &e.Raw, &e.Timestamp, &e.SPFResult, &e.DKIMResult, &e.DMARCResult)
 		if err != nil {
 			continue
 		}
-		
+
 		// Determine content type and process content
 		if e.HTML != "" {
 			e.ContentType = "text/html"
@@ -350,7 +571,7 @@ func emailsHandler(w http.ResponseWriter, r *http.Request) {
 				e.AnsiHTML = convertAnsiToHTML(e.Body)
 			}
 		}
-		
+
 		emails = append(emails, e)
 	}
 
@@ -358,21 +579,97 @@ func emailsHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(emails)
 }
 
-func emailHandler(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/api/email/")
-	
+// emailRouter dispatches the /api/email/ tree: the bare email resource,
+// its attachment list, and individual attachment downloads all share the
+// prefix, so they can't be registered as separate http.HandleFunc patterns.
+func emailRouter(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/email/")
+
+	if rest, ok := strings.CutSuffix(path, "/attachments"); ok {
+		attachmentsHandler(w, r, rest)
+		return
+	}
+	if emailID, n, ok := strings.Cut(path, "/attachment/"); ok {
+		attachmentHandler(w, r, emailID, n)
+		return
+	}
+	emailHandler(w, r, path)
+}
+
+// attachmentsHandler lists attachment metadata (without the bytes) for an email.
+func attachmentsHandler(w http.ResponseWriter, r *http.Request, emailID string) {
+	rows, err := db.Query(`
+		SELECT id, email_id, filename, content_type, size, content_id, sha256
+		FROM attachments
+		WHERE email_id = ?
+		ORDER BY id
+	`, emailID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.EmailID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.SHA256); err != nil {
+			continue
+		}
+		attachments = append(attachments, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachments)
+}
+
+// attachmentHandler streams the decoded bytes of the n-th (0-based, insertion
+// order) attachment on an email, with a Content-Disposition header so
+// browsers and mail clients download it under its original filename.
+func attachmentHandler(w http.ResponseWriter, r *http.Request, emailID, n string) {
+	var a Attachment
+	var data []byte
+	err := db.QueryRow(`
+		SELECT id, filename, content_type, size, content_id, sha256, data
+		FROM attachments
+		WHERE email_id = ?
+		ORDER BY id
+		LIMIT 1 OFFSET ?
+	`, emailID, n).Scan(&a.ID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.SHA256, &data)
+
+	if err != nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	filename := a.Filename
+	if filename == "" {
+		filename = fmt.Sprintf("attachment-%d", a.ID)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func emailHandler(w http.ResponseWriter, r *http.Request, id string) {
 	var e Email
 	err := db.QueryRow(`
-		SELECT id, from_addr, to_addr, subject, body, html, raw, timestamp
+		SELECT id, from_addr, to_addr, subject, body, html, raw, timestamp, spf_result, dkim_result, dmarc_result
 		FROM emails
 		WHERE id = ?
-	`, id).Scan(&e.ID, &e.From, &e.To, &e.Subject, &e.Body, &e.HTML, &e.Raw, &e.Timestamp)
+	`, id).Scan(&e.ID, &e.From, &e.To, &e.Subject, &e.Body, &e.HTML, &e.Raw, &e.Timestamp, &e.SPFResult, &e.DKIMResult, &e.DMARCResult)
 
 	if err != nil {
 		http.Error(w, "Email not found", http.StatusNotFound)
 		return
 	}
-	
+
 	// Determine content type and process content
 	if e.HTML != "" {
 		e.ContentType = "text/html"
@@ -386,6 +683,22 @@ func emailHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	rows, err := db.Query(`
+		SELECT id, email_id, filename, content_type, size, content_id, sha256
+		FROM attachments
+		WHERE email_id = ?
+		ORDER BY id
+	`, e.ID)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var a Attachment
+			if err := rows.Scan(&a.ID, &a.EmailID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.SHA256); err == nil {
+				e.Attachments = append(e.Attachments, a)
+			}
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(e)
 }
@@ -397,9 +710,38 @@ func main() {
 		dbPath   = flag.String("db", "mailsink.db", "SQLite database path")
 		forward  = flag.String("forward", "", "Forward emails to hostname or hostname:port (default port 25)")
 		starttls = flag.Bool("starttls", false, "Use STARTTLS when forwarding (without certificate verification)")
+
+		imapAddr    = flag.String("imap", "", "IMAP server address (empty disables IMAP)")
+		imapTLSCert = flag.String("imap-tls-cert", "", "TLS certificate file for the IMAP listener")
+		imapTLSKey  = flag.String("imap-tls-key", "", "TLS key file for the IMAP listener")
+		pop3Addr    = flag.String("pop3", "", "POP3 server address (empty disables POP3)")
+		pop3TLSCert = flag.String("pop3-tls-cert", "", "TLS certificate file for the POP3 listener")
+		pop3TLSKey  = flag.String("pop3-tls-key", "", "TLS key file for the POP3 listener")
+
+		authURLFlag = flag.String("auth-url", "", "nginx-style auth URL to validate MAIL FROM/RCPT TO against (empty disables the check)")
+
+		maxSize     = flag.String("max-size", "10MB", "Reject individual messages larger than this at SMTP DATA time (e.g. 10MB)")
+		maxMessages = flag.Int("max-messages", 0, "Delete the oldest emails once the store holds more than this many (0 disables)")
+		maxAge      = flag.Duration("max-age", 0, "Delete emails older than this (e.g. 168h) (0 disables)")
+		maxDBSize   = flag.String("max-db-size", "", "Delete the oldest emails once the database file exceeds this size (e.g. 1GB) (empty disables)")
+
+		webhookSecretFlag = flag.String("webhook-secret", "", "HMAC-SHA256 secret used to sign webhook payloads (empty disables signing)")
 	)
+	flag.Var(&webhookURLs, "webhook", "Webhook URL to POST newly received emails to (may be repeated)")
 	flag.Parse()
 
+	authURL = *authURLFlag
+	webhookSecret = *webhookSecretFlag
+
+	maxMessageSize, err := parseSize(*maxSize)
+	if err != nil {
+		log.Fatal("Invalid -max-size:", err)
+	}
+	maxDBSizeBytes, err := parseSize(*maxDBSize)
+	if err != nil {
+		log.Fatal("Invalid -max-db-size:", err)
+	}
+
 	// Parse forward address and add default port if needed
 	if *forward != "" {
 		if !strings.Contains(*forward, ":") {
@@ -416,31 +758,68 @@ func main() {
 	}
 
 	initSanitizer()
-	
+
 	if err := initDB(*dbPath); err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
 
 	srv := &smtpd.Server{
-		Handler:  mailHandler,
-		Hostname: "localhost",
+		Handler:        mailHandler,
+		Hostname:       "localhost",
 		WelcomeMessage: "MailSink ESMTP ready",
+		MaxMessageSize: int(maxMessageSize),
+	}
+
+	if authURL != "" {
+		srv.SenderChecker = authSenderChecker
+		srv.RecipientChecker = authRecipientChecker
+		log.Printf("Recipient validation enabled via %s", authURL)
 	}
 
+	go startRetentionWorker(retentionLimits{
+		maxMessages: *maxMessages,
+		maxAge:      *maxAge,
+		maxDBSize:   maxDBSizeBytes,
+	})
+
 	go func() {
 		log.Printf("Starting SMTP server on %s", *smtpAddr)
-		if err := srv.ListenAndServe(*smtpAddr); err != nil {
+		l, err := net.Listen("tcp", *smtpAddr)
+		if err != nil {
+			log.Fatal("SMTP server error:", err)
+		}
+		if authURL != "" {
+			l = wrapAuthCleanupListener(l)
+		}
+		if err := srv.Serve(l); err != nil {
 			log.Fatal("SMTP server error:", err)
 		}
 	}()
 
+	if *imapAddr != "" {
+		go func() {
+			if err := startIMAPServer(*imapAddr, *imapTLSCert, *imapTLSKey); err != nil {
+				log.Fatal("IMAP server error:", err)
+			}
+		}()
+	}
+
+	if *pop3Addr != "" {
+		go func() {
+			if err := startPOP3Server(*pop3Addr, *pop3TLSCert, *pop3TLSKey); err != nil {
+				log.Fatal("POP3 server error:", err)
+			}
+		}()
+	}
+
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/api/emails", emailsHandler)
-	http.HandleFunc("/api/email/", emailHandler)
+	http.HandleFunc("/api/email/", emailRouter)
+	http.HandleFunc("/api/stream", streamHandler)
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(templatesFS))))
 
 	log.Printf("Starting HTTP server on %s", *httpAddr)
 	if err := http.ListenAndServe(*httpAddr, nil); err != nil {
 		log.Fatal("HTTP server error:", err)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The POP3 frontend is a minimal, read-mostly companion to the IMAP
+// server: it serves the same emails table as a single mailbox. There is
+// no extension negotiation beyond USER/PASS/APOP-less auth - any
+// credentials are accepted - since, like IMAP, it exists for local/CI use
+// rather than as an Internet-facing mail store.
+
+type pop3Session struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	ids  []int64 // snapshot of email row IDs taken at login; message number n is ids[n-1]
+	del  map[int]bool
+}
+
+func startPOP3Server(addr, certFile, keyFile string) error {
+	var listener net.Listener
+	var err error
+
+	if certFile != "" && keyFile != "" {
+		tlsConfig, err := tlsCertificate(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		listener, err = tls.Listen("tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		log.Printf("Starting POP3 server on %s with TLS", addr)
+	} else {
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		log.Printf("Starting POP3 server on %s", addr)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go servePOP3Conn(conn)
+	}
+}
+
+func servePOP3Conn(conn net.Conn) {
+	defer conn.Close()
+
+	s := &pop3Session{
+		conn: conn,
+		rw:   bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		del:  make(map[int]bool),
+	}
+
+	s.writeLine("+OK MailSink POP3 ready")
+
+	for {
+		line, err := s.rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		cmd := strings.ToUpper(fields[0])
+		args := fields[1:]
+
+		switch cmd {
+		case "USER":
+			s.writeLine("+OK send PASS")
+		case "PASS":
+			if err := s.login(); err != nil {
+				s.writeLine("-ERR " + err.Error())
+				continue
+			}
+			s.writeLine(fmt.Sprintf("+OK mailbox ready, %d message(s)", len(s.ids)))
+		case "STAT":
+			s.handleStat()
+		case "LIST":
+			s.handleList(args)
+		case "UIDL":
+			s.handleUIDL(args)
+		case "RETR":
+			s.handleRetr(args)
+		case "TOP":
+			s.handleTop(args)
+		case "DELE":
+			s.handleDele(args)
+		case "RSET":
+			s.del = make(map[int]bool)
+			s.writeLine("+OK")
+		case "NOOP":
+			s.writeLine("+OK")
+		case "QUIT":
+			s.expunge()
+			s.writeLine("+OK goodbye")
+			return
+		default:
+			s.writeLine("-ERR unknown command")
+		}
+	}
+}
+
+func (s *pop3Session) writeLine(line string) {
+	s.rw.WriteString(line + "\r\n")
+	s.rw.Flush()
+}
+
+func (s *pop3Session) login() error {
+	ids, err := (&imapMailbox{}).orderedIDs()
+	if err != nil {
+		return err
+	}
+	s.ids = ids
+	return nil
+}
+
+// msgRaw loads the raw bytes of message number n (1-indexed), rejecting
+// messages already marked for deletion in this session.
+func (s *pop3Session) msgRaw(n int) (int64, []byte, error) {
+	if n < 1 || n > len(s.ids) || s.del[n] {
+		return 0, nil, fmt.Errorf("no such message")
+	}
+	id := s.ids[n-1]
+	var raw string
+	if err := db.QueryRow(`SELECT raw FROM emails WHERE id = ?`, id).Scan(&raw); err != nil {
+		return 0, nil, err
+	}
+	return id, []byte(raw), nil
+}
+
+func (s *pop3Session) handleStat() {
+	var total int
+	var size int
+	for n := range s.ids {
+		n++
+		if s.del[n] {
+			continue
+		}
+		_, raw, err := s.msgRaw(n)
+		if err != nil {
+			continue
+		}
+		total++
+		size += len(raw)
+	}
+	s.writeLine(fmt.Sprintf("+OK %d %d", total, size))
+}
+
+func (s *pop3Session) handleList(args []string) {
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			s.writeLine("-ERR invalid message number")
+			return
+		}
+		_, raw, err := s.msgRaw(n)
+		if err != nil {
+			s.writeLine("-ERR no such message")
+			return
+		}
+		s.writeLine(fmt.Sprintf("+OK %d %d", n, len(raw)))
+		return
+	}
+
+	s.writeLine("+OK")
+	for n := range s.ids {
+		n++
+		if s.del[n] {
+			continue
+		}
+		_, raw, err := s.msgRaw(n)
+		if err != nil {
+			continue
+		}
+		s.writeLine(fmt.Sprintf("%d %d", n, len(raw)))
+	}
+	s.writeLine(".")
+}
+
+func (s *pop3Session) handleUIDL(args []string) {
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			s.writeLine("-ERR invalid message number")
+			return
+		}
+		id, _, err := s.msgRaw(n)
+		if err != nil {
+			s.writeLine("-ERR no such message")
+			return
+		}
+		s.writeLine(fmt.Sprintf("+OK %d %s", n, pop3UID(id)))
+		return
+	}
+
+	s.writeLine("+OK")
+	for n := range s.ids {
+		n++
+		if s.del[n] {
+			continue
+		}
+		id, _, err := s.msgRaw(n)
+		if err != nil {
+			continue
+		}
+		s.writeLine(fmt.Sprintf("%d %s", n, pop3UID(id)))
+	}
+	s.writeLine(".")
+}
+
+// pop3UID derives a stable opaque UIDL token from the row ID, since the
+// POP3 UIDL must persist across sessions but shouldn't just be the raw
+// database ID.
+func pop3UID(id int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("mailsink-%d", id)))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+func (s *pop3Session) handleRetr(args []string) {
+	if len(args) != 1 {
+		s.writeLine("-ERR usage: RETR n")
+		return
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		s.writeLine("-ERR invalid message number")
+		return
+	}
+	_, raw, err := s.msgRaw(n)
+	if err != nil {
+		s.writeLine("-ERR no such message")
+		return
+	}
+
+	s.writeLine(fmt.Sprintf("+OK %d octets", len(raw)))
+	writeDotStuffed(s.rw, raw)
+	s.writeLine(".")
+}
+
+func (s *pop3Session) handleTop(args []string) {
+	if len(args) != 2 {
+		s.writeLine("-ERR usage: TOP n lines")
+		return
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		s.writeLine("-ERR invalid message number")
+		return
+	}
+	lines, err := strconv.Atoi(args[1])
+	if err != nil || lines < 0 {
+		s.writeLine("-ERR invalid line count")
+		return
+	}
+	_, raw, err := s.msgRaw(n)
+	if err != nil {
+		s.writeLine("-ERR no such message")
+		return
+	}
+
+	headerEnd := strings.Index(string(raw), "\r\n\r\n")
+	sep := "\r\n\r\n"
+	if headerEnd == -1 {
+		headerEnd = strings.Index(string(raw), "\n\n")
+		sep = "\n\n"
+	}
+
+	s.writeLine("+OK")
+	if headerEnd == -1 {
+		writeDotStuffed(s.rw, raw)
+	} else {
+		writeDotStuffed(s.rw, raw[:headerEnd])
+		s.rw.WriteString(sep)
+
+		bodyLines := strings.SplitAfter(string(raw[headerEnd+len(sep):]), "\n")
+		if lines < len(bodyLines) {
+			bodyLines = bodyLines[:lines]
+		}
+		writeDotStuffed(s.rw, []byte(strings.Join(bodyLines, "")))
+	}
+	s.rw.Flush()
+	s.writeLine(".")
+}
+
+func (s *pop3Session) handleDele(args []string) {
+	if len(args) != 1 {
+		s.writeLine("-ERR usage: DELE n")
+		return
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		s.writeLine("-ERR invalid message number")
+		return
+	}
+	if _, _, err := s.msgRaw(n); err != nil {
+		s.writeLine("-ERR no such message")
+		return
+	}
+	s.del[n] = true
+	s.writeLine(fmt.Sprintf("+OK message %d deleted", n))
+}
+
+// expunge permanently removes messages marked with DELE, mirroring the
+// real POP3 semantics where deletion only takes effect at QUIT.
+func (s *pop3Session) expunge() {
+	for n := range s.del {
+		if n < 1 || n > len(s.ids) {
+			continue
+		}
+		if _, err := db.Exec(`DELETE FROM emails WHERE id = ?`, s.ids[n-1]); err != nil {
+			log.Printf("POP3: failed to expunge message %d: %v", n, err)
+		}
+	}
+}
+
+// writeDotStuffed writes raw with POP3 byte-stuffing: lines starting with
+// "." get an extra leading "." so the client can find the terminating
+// "." line unambiguously.
+func writeDotStuffed(w *bufio.ReadWriter, data []byte) {
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, ".") {
+			w.WriteString(".")
+		}
+		w.WriteString(line)
+	}
+	w.Flush()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhookURLs and webhookSecret are populated from the repeatable -webhook
+// flag and -webhook-secret respectively.
+var (
+	webhookURLs   stringSliceFlag
+	webhookSecret string
+)
+
+// stringSliceFlag implements flag.Value to accept a flag multiple times,
+// collecting each occurrence (used by -webhook).
+type stringSliceFlag []string
+
+func (s *stringSliceFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringSliceFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// publishEmail fans a newly stored email out to every configured webhook
+// and to any browsers connected to /api/stream. Called right after
+// mailHandler commits the email (and its attachments) to the database.
+func publishEmail(e Email) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to marshal email for webhook/SSE: %v", err)
+		return
+	}
+
+	broadcastSSE(payload)
+
+	for _, url := range webhookURLs {
+		go deliverWebhook(url, payload)
+	}
+}
+
+const (
+	webhookMaxAttempts = 5
+	webhookBaseBackoff = time.Second
+)
+
+// deliverWebhook POSTs payload to url, retrying with exponential backoff on
+// failure or a non-2xx response. If webhookSecret is set, payload is signed
+// with HMAC-SHA256 and the signature sent as X-MailSink-Signature.
+func deliverWebhook(url string, payload []byte) {
+	backoff := webhookBaseBackoff
+
+	for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+		err := postWebhook(url, payload)
+		if err == nil {
+			return
+		}
+
+		log.Printf("Webhook delivery to %s failed (attempt %d/%d): %v", url, attempt, webhookMaxAttempts, err)
+		if attempt < webhookMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func postWebhook(url string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(webhookSecret))
+		mac.Write(payload)
+		req.Header.Set("X-MailSink-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// sseClients holds one channel per connected /api/stream client.
+var (
+	sseClientsMu sync.Mutex
+	sseClients   = make(map[chan []byte]bool)
+)
+
+func broadcastSSE(payload []byte) {
+	sseClientsMu.Lock()
+	defer sseClientsMu.Unlock()
+
+	for ch := range sseClients {
+		select {
+		case ch <- payload:
+		default:
+			// Slow client; drop the update rather than block ingestion.
+		}
+	}
+}
+
+// streamHandler serves /api/stream: a Server-Sent Events feed of newly
+// received emails, so the index page can update live instead of polling
+// /api/emails.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := make(chan []byte, 8)
+	sseClientsMu.Lock()
+	sseClients[ch] = true
+	sseClientsMu.Unlock()
+
+	defer func() {
+		sseClientsMu.Lock()
+		delete(sseClients, ch)
+		sseClientsMu.Unlock()
+	}()
+
+	for {
+		select {
+		case payload := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", payload)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
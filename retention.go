@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// purgeInterval is how often the retention worker checks the configured
+// limits. It's intentionally not configurable via flag since developers
+// care about the limits themselves, not the polling cadence.
+const purgeInterval = 30 * time.Second
+
+// retentionLimits holds the -max-messages/-max-age/-max-db-size flags. A
+// zero value for any field means that limit is disabled.
+type retentionLimits struct {
+	maxMessages int
+	maxAge      time.Duration
+	maxDBSize   int64
+}
+
+func (l retentionLimits) enabled() bool {
+	return l.maxMessages > 0 || l.maxAge > 0 || l.maxDBSize > 0
+}
+
+// startRetentionWorker runs until the process exits, periodically deleting
+// the oldest emails (and their attachments and FTS rows, via the FTS
+// trigger and the attachments table's foreign key) once any configured
+// limit is exceeded, and VACUUMing afterwards to actually reclaim the
+// freed space on disk.
+func startRetentionWorker(limits retentionLimits) {
+	if !limits.enabled() {
+		return
+	}
+
+	log.Printf("Retention worker started (max-messages=%d max-age=%s max-db-size=%d)",
+		limits.maxMessages, limits.maxAge, limits.maxDBSize)
+
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := purgeOnce(limits)
+		if err != nil {
+			log.Printf("Retention worker error: %v", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Retention worker purged %d email(s)", purged)
+			if _, err := db.Exec("VACUUM"); err != nil {
+				log.Printf("Retention worker: VACUUM failed: %v", err)
+			}
+		}
+	}
+}
+
+func purgeOnce(limits retentionLimits) (int64, error) {
+	var purged int64
+
+	if limits.maxAge > 0 {
+		cutoff := time.Now().Add(-limits.maxAge)
+		res, err := db.Exec(`DELETE FROM emails WHERE timestamp < ?`, cutoff)
+		if err != nil {
+			return purged, err
+		}
+		n, _ := res.RowsAffected()
+		purged += n
+	}
+
+	if limits.maxMessages > 0 {
+		res, err := db.Exec(`
+			DELETE FROM emails WHERE id NOT IN (
+				SELECT id FROM emails ORDER BY id DESC LIMIT ?
+			)
+		`, limits.maxMessages)
+		if err != nil {
+			return purged, err
+		}
+		n, _ := res.RowsAffected()
+		purged += n
+	}
+
+	if limits.maxDBSize > 0 {
+		n, err := purgeForSize(limits.maxDBSize)
+		if err != nil {
+			return purged, err
+		}
+		purged += n
+	}
+
+	return purged, nil
+}
+
+// purgeForSize deletes the oldest email, one at a time, until the database
+// is at or under maxSize. Deleting one row at a time keeps the overshoot
+// small since a single row can carry large attachments.
+//
+// It can't just stat dbPath between deletes: SQLite doesn't shrink the file
+// on DELETE, so the on-disk size wouldn't move until the VACUUM that runs
+// after purgeOnce returns, and the loop would delete every row before
+// noticing it was under the limit. dbUsedBytes instead derives the live,
+// still-in-use size from page_count/freelist_count, which does shrink as
+// rows are deleted.
+func purgeForSize(maxSize int64) (int64, error) {
+	var purged int64
+	for {
+		used, err := dbUsedBytes()
+		if err != nil {
+			return purged, err
+		}
+		if used <= maxSize {
+			return purged, nil
+		}
+
+		res, err := db.Exec(`DELETE FROM emails WHERE id = (SELECT MIN(id) FROM emails)`)
+		if err != nil {
+			return purged, err
+		}
+		n, _ := res.RowsAffected()
+		if n == 0 {
+			// No more messages to delete, but still over the limit - give up.
+			return purged, nil
+		}
+		purged += n
+	}
+}
+
+// dbUsedBytes returns the portion of the database file actually holding
+// live data, i.e. excluding pages SQLite has already freed but not yet
+// returned to the filesystem (that only happens on VACUUM).
+func dbUsedBytes() (int64, error) {
+	var pageCount, pageSize, freelistCount int64
+	if err := db.QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+		return 0, err
+	}
+	if err := db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	if err := db.QueryRow("PRAGMA freelist_count").Scan(&freelistCount); err != nil {
+		return 0, err
+	}
+	return (pageCount - freelistCount) * pageSize, nil
+}
+
+// parseSize parses a human-readable byte size like "500MB", "2GiB" or a
+// plain number of bytes. An empty string returns 0 (no limit).
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"GIB", 1 << 30}, {"GB", 1e9}, {"G", 1e9},
+		{"MIB", 1 << 20}, {"MB", 1e6}, {"M", 1e6},
+		{"KIB", 1 << 10}, {"KB", 1e3}, {"K", 1e3},
+		{"B", 1},
+	}
+
+	upper := strings.ToUpper(s)
+	for _, u := range units {
+		if strings.HasSuffix(upper, u.suffix) {
+			numeric := strings.TrimSpace(s[:len(s)-len(u.suffix)])
+			value, err := strconv.ParseFloat(numeric, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid size %q: %w", s, err)
+			}
+			return int64(value * float64(u.multiplier)), nil
+		}
+	}
+
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/chrj/smtpd"
+)
+
+// authURL, when set, is queried before accepting MAIL FROM/RCPT TO,
+// nginx mail-auth-protocol style: a 2xx response accepts the address, any
+// other response rejects it using the response status as the SMTP error.
+var authURL string
+
+// pendingSenders remembers the MAIL FROM address seen for each in-progress
+// SMTP session, keyed by peer address, so the RCPT TO check can include it
+// as Auth-SMTP-From. smtpd doesn't give RecipientChecker the envelope
+// sender directly, since the envelope isn't finalized until DATA.
+var pendingSenders sync.Map
+
+// checkAuthURL issues the nginx-style auth subrequest described by -auth-url
+// and reports whether the given SMTP address should be accepted.
+func checkAuthURL(peer smtpd.Peer, smtpFrom, smtpTo string) error {
+	if authURL == "" {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, authURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Auth-Method", "plain")
+	req.Header.Set("Auth-User", peer.Username)
+	req.Header.Set("Auth-Pass", peer.Password)
+	req.Header.Set("Auth-Protocol", "smtp")
+	req.Header.Set("Auth-SMTP-From", smtpFrom)
+	req.Header.Set("Auth-SMTP-To", smtpTo)
+	req.Header.Set("Auth-SMTP-Helo", peer.HeloName)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return smtpd.Error{Code: 451, Message: fmt.Sprintf("auth check failed: %v", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return smtpd.Error{Code: 550, Message: resp.Status}
+}
+
+// authSenderChecker is installed as smtpd.Server.SenderChecker when
+// -auth-url is set.
+func authSenderChecker(peer smtpd.Peer, addr string) error {
+	if err := checkAuthURL(peer, addr, ""); err != nil {
+		return err
+	}
+	pendingSenders.Store(peer.Addr.String(), addr)
+	return nil
+}
+
+// authRecipientChecker is installed as smtpd.Server.RecipientChecker when
+// -auth-url is set.
+func authRecipientChecker(peer smtpd.Peer, addr string) error {
+	sender, _ := pendingSenders.Load(peer.Addr.String())
+	smtpFrom, _ := sender.(string)
+	return checkAuthURL(peer, smtpFrom, addr)
+}
+
+// wrapAuthCleanupListener wraps l so that pendingSenders forgets a
+// connection's entry as soon as the connection closes. This is the only
+// place entries are removed: mailHandler does not clear them, and a MAIL
+// FROM can also be followed by a RCPT TO the auth URL rejects, or by the
+// client simply disconnecting - without this, every session would leak
+// its entry for the life of the process.
+func wrapAuthCleanupListener(l net.Listener) net.Listener {
+	return &authCleanupListener{l}
+}
+
+type authCleanupListener struct {
+	net.Listener
+}
+
+func (l *authCleanupListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &authCleanupConn{Conn: conn}, nil
+}
+
+type authCleanupConn struct {
+	net.Conn
+}
+
+func (c *authCleanupConn) Close() error {
+	pendingSenders.Delete(c.Conn.RemoteAddr().String())
+	return c.Conn.Close()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/chrj/smtpd"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+)
+
+// dnsCheckTimeout bounds the SPF, DKIM, and DMARC DNS lookups done at
+// ingest time. All three run synchronously in mailHandler before the
+// message is stored, so a slow or unreachable resolver must fail fast
+// rather than stall SMTP ingestion. A timed-out SPF or DMARC check yields
+// verdictNone; a timed-out DKIM key lookup counts as a failed signature.
+const dnsCheckTimeout = 5 * time.Second
+
+// authVerdict is one of the RFC 8601 Authentication-Results values this
+// package cares about: "pass", "fail", "softfail", "neutral", "temperror",
+// "permerror", or "none" when the mechanism couldn't be evaluated at all.
+type authVerdict string
+
+const (
+	verdictNone authVerdict = "none"
+	verdictPass authVerdict = "pass"
+	verdictFail authVerdict = "fail"
+)
+
+// emailAuth holds the SPF/DKIM/DMARC verdicts computed for a message at
+// ingest time, for storage alongside it and display in the UI.
+type emailAuth struct {
+	SPF   authVerdict
+	DKIM  authVerdict
+	DMARC authVerdict
+}
+
+// verifyEmail runs a live SPF check against the connecting peer and MAIL
+// FROM, and a live DKIM signature check against the raw message, falling
+// back to whatever an upstream relay already recorded in an
+// Authentication-Results header for whichever mechanism the live check
+// couldn't evaluate. DMARC is then derived from the SPF/DKIM domains and
+// the message's From header.
+func verifyEmail(peer smtpd.Peer, mailFrom, raw string) emailAuth {
+	msg, _ := mail.ReadMessage(strings.NewReader(raw))
+
+	spfResult, spfDomain := checkSPF(peer, mailFrom)
+	dkimResult, dkimDomain := checkDKIM(raw)
+
+	if msg != nil {
+		existing := existingAuthResults(msg)
+		if spfResult == verdictNone && existing.SPF != "" {
+			spfResult = existing.SPF
+		}
+		if dkimResult == verdictNone && existing.DKIM != "" {
+			dkimResult = existing.DKIM
+		}
+	}
+
+	return emailAuth{
+		SPF:   spfResult,
+		DKIM:  dkimResult,
+		DMARC: checkDMARC(msg, spfResult, spfDomain, dkimResult, dkimDomain),
+	}
+}
+
+// checkSPF evaluates the SPF record of the MAIL FROM domain (falling back
+// to the HELO/EHLO name for the null sender) against the connecting peer's
+// IP. It returns the verdict and the domain that was checked, for DMARC
+// alignment.
+func checkSPF(peer smtpd.Peer, mailFrom string) (authVerdict, string) {
+	ip := peerIP(peer.Addr)
+	if ip == nil {
+		return verdictNone, ""
+	}
+
+	_, domain := splitAddr(mailFrom)
+	if domain == "" {
+		domain = peer.HeloName
+	}
+	if domain == "" {
+		return verdictNone, ""
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsCheckTimeout)
+	defer cancel()
+
+	result, err := spf.CheckHostWithSender(ip, peer.HeloName, mailFrom, spf.WithContext(ctx))
+	if err != nil && ctx.Err() != nil {
+		return verdictNone, domain
+	}
+	return authVerdict(result), domain
+}
+
+func peerIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+func splitAddr(addr string) (local, domain string) {
+	local, domain, _ = strings.Cut(addr, "@")
+	return local, domain
+}
+
+// checkDKIM verifies every DKIM-Signature on the raw message and returns
+// "pass" if at least one validates, "fail" if every signature present is
+// invalid, or "none" if the message isn't signed at all. It also returns
+// the SDID (d=) of the first passing signature, for DMARC alignment.
+func checkDKIM(raw string) (authVerdict, string) {
+	verifications, err := dkim.VerifyWithOptions(strings.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), dnsCheckTimeout)
+			defer cancel()
+			return net.DefaultResolver.LookupTXT(ctx, name)
+		},
+	})
+	if err != nil || len(verifications) == 0 {
+		return verdictNone, ""
+	}
+
+	for _, v := range verifications {
+		if v.Err == nil {
+			return verdictPass, v.Domain
+		}
+	}
+	return verdictFail, ""
+}
+
+// checkDMARC looks up the DMARC policy for the From header's domain and
+// checks whether the SPF- or DKIM-authenticated domain aligns with it, per
+// RFC 7489. It returns "none" when the domain publishes no DMARC record.
+func checkDMARC(msg *mail.Message, spfResult authVerdict, spfDomain string, dkimResult authVerdict, dkimDomain string) authVerdict {
+	fromDomain := headerFromDomain(msg)
+	if fromDomain == "" {
+		return verdictNone
+	}
+
+	record, err := dmarc.LookupWithOptions(fromDomain, &dmarc.LookupOptions{
+		LookupTXT: func(name string) ([]string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), dnsCheckTimeout)
+			defer cancel()
+			return net.DefaultResolver.LookupTXT(ctx, name)
+		},
+	})
+	if err != nil {
+		return verdictNone
+	}
+
+	spfAligned := spfResult == verdictPass && aligned(spfDomain, fromDomain, record.SPFAlignment)
+	dkimAligned := dkimResult == verdictPass && aligned(dkimDomain, fromDomain, record.DKIMAlignment)
+
+	if spfAligned || dkimAligned {
+		return verdictPass
+	}
+	return verdictFail
+}
+
+// aligned reports whether signerDomain is aligned with fromDomain under
+// mode. Strict alignment requires an exact match; relaxed alignment (the
+// default) only requires the same organizational domain. There's no public
+// suffix list here, so the organizational domain is approximated as the
+// last two labels, which is correct for the vast majority of domains.
+func aligned(signerDomain, fromDomain string, mode dmarc.AlignmentMode) bool {
+	if signerDomain == "" {
+		return false
+	}
+	if strings.EqualFold(signerDomain, fromDomain) {
+		return true
+	}
+	if mode == dmarc.AlignmentStrict {
+		return false
+	}
+	return strings.EqualFold(orgDomain(signerDomain), orgDomain(fromDomain))
+}
+
+func orgDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+	if len(labels) <= 2 {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// headerFromDomain extracts the domain part of the message's From header.
+func headerFromDomain(msg *mail.Message) string {
+	if msg == nil {
+		return ""
+	}
+	addr, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return ""
+	}
+	_, domain := splitAddr(addr.Address)
+	return domain
+}
+
+// existingSPFDKIM is the subset of an already-present Authentication-Results
+// header this package falls back to.
+type existingSPFDKIM struct {
+	SPF  authVerdict
+	DKIM authVerdict
+}
+
+// existingAuthResults parses any Authentication-Results headers the message
+// already carries (typically added by an upstream relay before it reached
+// this server) and returns the first SPF and DKIM verdict found in them.
+func existingAuthResults(msg *mail.Message) *existingSPFDKIM {
+	result := &existingSPFDKIM{}
+	for _, header := range msg.Header["Authentication-Results"] {
+		_, results, err := authres.Parse(header)
+		if err != nil {
+			continue
+		}
+		for _, r := range results {
+			switch res := r.(type) {
+			case *authres.SPFResult:
+				if result.SPF == "" {
+					result.SPF = authVerdict(res.Value)
+				}
+			case *authres.DKIMResult:
+				if result.DKIM == "" {
+					result.DKIM = authVerdict(res.Value)
+				}
+			}
+		}
+	}
+	return result
+}